@@ -26,9 +26,27 @@ import "time"
 import "flag"
 import "context"
 import "io/ioutil"
+import "io"
+import "sync"
+import "bytes"
+import "strings"
+import "net/http"
+import "sync/atomic"
+import "crypto/md5"
+import "crypto/sha256"
+import "encoding/hex"
 import "encoding/json"
+import "encoding/xml"
+import "net/url"
 import "github.com/minio/minio-go/v7"
 import "github.com/minio/minio-go/v7/pkg/credentials"
+import "github.com/minio/minio-go/v7/pkg/lifecycle"
+
+type LifecycleRule struct {
+	Prefix string
+	ExpiryHours uint
+	Enabled bool
+}
 
 type Conf struct {
 	Endpoint string
@@ -38,6 +56,12 @@ type Conf struct {
 	DefaultExpiryTime uint
 	DefaultBucket string
 	DefaultTimeoutMS uint
+	LifecycleRules []LifecycleRule
+	ObjectLockMode string
+	ObjectLockRetainDays uint
+	CredentialSource string
+	Profile string
+	Alias string
 }
 
 var config Conf
@@ -56,6 +80,14 @@ func write_example_config( path string ){
 		DefaultExpiryTime: 48,
 		DefaultBucket: "my-vm-images",
 		DefaultTimeoutMS: 1000,
+		LifecycleRules: []LifecycleRule{
+			{ Prefix: "templates/", ExpiryHours: 48, Enabled: true },
+			},
+		ObjectLockMode: "GOVERNANCE",
+		ObjectLockRetainDays: 7,
+		CredentialSource: "static",
+		Profile: "",
+		Alias: "",
 		}
 	
 	confser, err := json.MarshalIndent( example_config ,"","	")
@@ -78,11 +110,54 @@ func load_config( path string ){
 	}
 
 var s3_client *minio.Client
+var s3_core *minio.Core
+
+func s3_build_credentials() *credentials.Credentials {
+	switch config.CredentialSource {
+	case "", "static":
+		return credentials.NewStaticV4( config.AccessKey, config.SecretKey, "" )
+	case "env":
+		return credentials.NewChainCredentials( []credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		})
+	case "file":
+		return credentials.NewChainCredentials( []credentials.Provider{
+			&credentials.FileAWSCredentials{ Profile: config.Profile },
+			&credentials.FileMinioClient{ Alias: config.Alias },
+		})
+	case "iam":
+		return credentials.NewIAM("")
+	case "chain":
+		return credentials.NewChainCredentials( []credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{ Profile: config.Profile },
+			&credentials.FileMinioClient{ Alias: config.Alias },
+			&credentials.IAM{ Client: &http.Client{ Transport: http.DefaultTransport } },
+		})
+	default:
+		log.Printf("unknown CredentialSource %q, falling back to static\n", config.CredentialSource)
+		return credentials.NewStaticV4( config.AccessKey, config.SecretKey, "" )
+	}
+}
 
 func s3_setup_client() {
 	var err error
 	s3_client, err = minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4( config.AccessKey, config.SecretKey, "" ),
+		Creds:  s3_build_credentials(),
+		Secure: config.HTTPS,
+	})
+	if err != nil {
+		log.Fatalln(err)
+		os.Exit(1)
+	}
+}
+
+func s3_setup_core_client() {
+	var err error
+	s3_core, err = minio.NewCore(config.Endpoint, &minio.Options{
+		Creds:  s3_build_credentials(),
 		Secure: config.HTTPS,
 	})
 	if err != nil {
@@ -126,11 +201,27 @@ func s3_check_object_expiry( bucket string, object string, remove_expired bool )
 				fmt.Printf("%s/%s expired\n", bucket, object)
 			}
 			if remove_expired {
+				ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+				defer cancelCtx()
+				mode, retainUntil, rerr := s3_client.GetObjectRetention( ctx, bucket, object, "" )
+				if debug {
+					log.Printf("retention mode=%v retainUntil=%v err=%v\n", mode, retainUntil, rerr)
+				}
+				if rerr == nil && mode != nil && retainUntil != nil && time.Now().Before( *retainUntil ) {
+					log.Printf("refusing to remove %s/%s: object is under %s retention until %s\n", bucket, object, *mode, retainUntil )
+					os.Exit(1)
+				}
+				hold, herr := s3_client.GetObjectLegalHold( ctx, bucket, object, minio.GetObjectLegalHoldOptions{} )
+				if debug {
+					log.Printf("legal hold=%v err=%v\n", hold, herr)
+				}
+				if herr == nil && hold != nil && *hold == minio.LegalHoldEnabled {
+					log.Printf("refusing to remove %s/%s: object is under legal hold\n", bucket, object)
+					os.Exit(1)
+				}
 				if ! quiet {
 					fmt.Printf("Removing object %s/%s\n", bucket, object)
 				}
-				ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
-				defer cancelCtx()
 				err := s3_client.RemoveObject(ctx, bucket, object, minio.RemoveObjectOptions{} )
 				if err != nil{
 					log.Printf("Error while deleting object %s/%s : %s\n", bucket, object, err)
@@ -149,6 +240,694 @@ func s3_check_object_expiry( bucket string, object string, remove_expired bool )
 	return( false )
 }
 
+// s3_expiry_days rounds hours up to whole days since S3 lifecycle expiration
+// only accepts a day granularity; truncating would silently zero out any
+// rule with ExpiryHours < 24.
+func s3_expiry_days( hours uint ) lifecycle.ExpirationDays {
+	days := ( hours + 23 ) / 24
+	if days < 1 {
+		days = 1
+	}
+	return lifecycle.ExpirationDays( days )
+}
+
+func s3_build_lifecycle_config() *lifecycle.Configuration {
+	lfc := lifecycle.NewConfiguration()
+	if len( config.LifecycleRules ) == 0 {
+		lfc.Rules = []lifecycle.Rule{
+			{
+				ID: "default-expiry",
+				Status: "Enabled",
+				RuleFilter: lifecycle.Filter{ Prefix: "" },
+				Expiration: lifecycle.Expiration{ Days: s3_expiry_days( config.DefaultExpiryTime ) },
+			},
+		}
+		return lfc
+	}
+	for i, rule := range config.LifecycleRules {
+		status := "Enabled"
+		if ! rule.Enabled {
+			status = "Disabled"
+		}
+		lfc.Rules = append( lfc.Rules, lifecycle.Rule{
+			ID: fmt.Sprintf( "rule-%d", i ),
+			Status: status,
+			RuleFilter: lifecycle.Filter{ Prefix: rule.Prefix },
+			Expiration: lifecycle.Expiration{ Days: s3_expiry_days( rule.ExpiryHours ) },
+		})
+	}
+	return lfc
+}
+
+func s3_apply_lifecycle( bucket string, dry_run bool ) {
+	lfc := s3_build_lifecycle_config()
+
+	if dry_run {
+		raw, err := xml.MarshalIndent( lfc, "", "	" )
+		if err != nil {
+			log.Printf("error marshaling lifecycle config: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println( string(raw) )
+		return
+	}
+
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+	err := s3_client.SetBucketLifecycle( ctx, bucket, lfc )
+	if err != nil {
+		log.Printf("error setting bucket lifecycle on %s: %s\n", bucket, err)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("lifecycle configuration applied to %s\n", bucket)
+	}
+}
+
+func s3_dump_lifecycle( bucket string ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+	lfc, err := s3_client.GetBucketLifecycle( ctx, bucket )
+	if err != nil {
+		log.Printf("error fetching bucket lifecycle from %s: %s\n", bucket, err)
+		os.Exit(1)
+	}
+	raw, err := xml.MarshalIndent( lfc, "", "	" )
+	if err != nil {
+		log.Printf("error marshaling lifecycle config: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println( string(raw) )
+}
+
+func s3_retention_mode() *minio.RetentionMode {
+	mode := minio.RetentionMode( config.ObjectLockMode )
+	if mode != minio.Governance && mode != minio.Compliance {
+		log.Printf("invalid ObjectLockMode %q, must be GOVERNANCE or COMPLIANCE\n", config.ObjectLockMode )
+		os.Exit(1)
+	}
+	return &mode
+}
+
+func s3_ensure_bucket( bucket string, object_lock bool ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	exists, err := s3_client.BucketExists( ctx, bucket )
+	if err != nil {
+		log.Printf("error checking bucket %s : %s\n", bucket, err)
+		os.Exit(1)
+	}
+	if exists {
+		return
+	}
+	err = s3_client.MakeBucket( ctx, bucket, minio.MakeBucketOptions{ ObjectLocking: object_lock } )
+	if err != nil {
+		log.Printf("error creating bucket %s : %s\n", bucket, err)
+		os.Exit(1)
+	}
+}
+
+func s3_put_template( bucket string, object string, file_path string ) {
+	s3_ensure_bucket( bucket, config.ObjectLockRetainDays > 0 )
+
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	_, err := s3_client.FPutObject( ctx, bucket, object, file_path, minio.PutObjectOptions{} )
+	if err != nil {
+		log.Printf("error uploading %s as %s/%s : %s\n", file_path, bucket, object, err)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("uploaded %s to %s/%s\n", file_path, bucket, object)
+	}
+
+	if config.ObjectLockRetainDays > 0 {
+		s3_set_retention( bucket, object )
+	}
+}
+
+func s3_set_retention( bucket string, object string ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	retainUntil := time.Now().Add( time.Hour * 24 * time.Duration( config.ObjectLockRetainDays ) )
+	err := s3_client.PutObjectRetention( ctx, bucket, object, minio.PutObjectRetentionOptions{
+		Mode: s3_retention_mode(),
+		RetainUntilDate: &retainUntil,
+	})
+	if err != nil {
+		log.Printf("error setting retention on %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("%s/%s retained under %s until %s\n", bucket, object, config.ObjectLockMode, retainUntil )
+	}
+}
+
+func s3_legal_hold( bucket string, object string, on bool ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	status := minio.LegalHoldDisabled
+	if on {
+		status = minio.LegalHoldEnabled
+	}
+	err := s3_client.PutObjectLegalHold( ctx, bucket, object, minio.PutObjectLegalHoldOptions{ Status: &status } )
+	if err != nil {
+		log.Printf("error setting legal hold on %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("%s/%s legal hold: %s\n", bucket, object, status )
+	}
+}
+
+const max_presign_expiry = time.Hour * 24 * 7
+
+func s3_presign_reqparams() url.Values {
+	reqParams := make( url.Values )
+	if response_content_disposition != "" {
+		reqParams.Set( "response-content-disposition", response_content_disposition )
+	}
+	if response_content_type != "" {
+		reqParams.Set( "response-content-type", response_content_type )
+	}
+	return reqParams
+}
+
+func s3_presign_expiry() time.Duration {
+	expiry := time.Hour * time.Duration( presign_expiry_hours )
+	if presign_expiry_hours == 0 {
+		expiry = time.Hour * time.Duration( config.DefaultExpiryTime )
+	}
+	if expiry > max_presign_expiry {
+		log.Printf("-presign_expiry capped at S3's 7-day limit\n")
+		expiry = max_presign_expiry
+	}
+	return expiry
+}
+
+func s3_presign_get( bucket string, object string ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	presignedURL, err := s3_client.PresignedGetObject( ctx, bucket, object, s3_presign_expiry(), s3_presign_reqparams() )
+	if err != nil {
+		log.Printf("error presigning GET for %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+	s3_print_presigned_url( presignedURL.String() )
+}
+
+func s3_presign_put( bucket string, object string ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	presignedURL, err := s3_client.PresignedPutObject( ctx, bucket, object, s3_presign_expiry() )
+	if err != nil {
+		log.Printf("error presigning PUT for %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+	s3_print_presigned_url( presignedURL.String() )
+}
+
+func s3_print_presigned_url( presignedURL string ) {
+	if json_output {
+		out, _ := json.Marshal( map[string]string{ "url": presignedURL } )
+		fmt.Println( string(out) )
+		return
+	}
+	fmt.Println( presignedURL )
+}
+
+func s3_sha256_file( path string ) string {
+	file, err := os.Open( path )
+	if err != nil {
+		log.Printf("error opening %s : %s\n", path, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy( hasher, file ); err != nil {
+		log.Printf("error hashing %s : %s\n", path, err)
+		os.Exit(1)
+	}
+	return hex.EncodeToString( hasher.Sum(nil) )
+}
+
+func s3_find_multipart_upload( bucket string, object string ) string {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	key_marker := ""
+	upload_id_marker := ""
+	for {
+		result, err := s3_core.ListMultipartUploads( ctx, bucket, object, key_marker, upload_id_marker, "", 1000 )
+		if err != nil {
+			log.Printf("error listing multipart uploads for %s/%s : %s\n", bucket, object, err)
+			os.Exit(1)
+		}
+		for _, upload := range result.Uploads {
+			if upload.Key == object {
+				return upload.UploadID
+			}
+		}
+		if ! result.IsTruncated {
+			return ""
+		}
+		key_marker = result.NextKeyMarker
+		upload_id_marker = result.NextUploadIDMarker
+	}
+}
+
+func s3_upload( bucket string, object string, file_path string, part_size uint64, num_threads uint ) {
+	sha256sum := s3_sha256_file( file_path )
+	if ! quiet {
+		fmt.Printf("sha256(%s) = %s\n", file_path, sha256sum)
+	}
+
+	s3_setup_core_client()
+	upload_id := s3_find_multipart_upload( bucket, object )
+	if upload_id != "" {
+		if ! quiet {
+			fmt.Printf("resuming multipart upload %s for %s/%s\n", upload_id, bucket, object)
+		}
+		s3_resume_multipart( bucket, object, file_path, upload_id, part_size )
+		return
+	}
+
+	// no deadline: this streams a potentially multi-GB image, unlike the metadata calls above
+	info, err := s3_client.FPutObject( context.Background(), bucket, object, file_path, minio.PutObjectOptions{
+		PartSize: part_size,
+		NumThreads: num_threads,
+		UserMetadata: map[string]string{ "sha256": sha256sum },
+	})
+	if err != nil {
+		log.Printf("error uploading %s to %s/%s : %s\n", file_path, bucket, object, err)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("uploaded %s to %s/%s, ETag=%s\n", file_path, bucket, object, info.ETag)
+	}
+}
+
+func s3_resume_multipart( bucket string, object string, file_path string, upload_id string, part_size uint64 ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	have_etags := make( map[int]string )
+	part_number_marker := 0
+	for {
+		existing, err := s3_core.ListObjectParts( ctx, bucket, object, upload_id, part_number_marker, 1000 )
+		if err != nil {
+			log.Printf("error listing parts for upload %s : %s\n", upload_id, err)
+			os.Exit(1)
+		}
+		for _, part := range existing.ObjectParts {
+			have_etags[ part.PartNumber ] = part.ETag
+		}
+		if ! existing.IsTruncated {
+			break
+		}
+		part_number_marker = existing.NextPartNumberMarker
+	}
+
+	file, err := os.Open( file_path )
+	if err != nil {
+		log.Printf("error opening %s : %s\n", file_path, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var parts []minio.CompletePart
+	buf := make([]byte, part_size)
+	part_number := 1
+	for {
+		n, rerr := io.ReadFull( file, buf )
+		if n == 0 {
+			break
+		}
+		hasher := md5.Sum( buf[:n] )
+		local_etag := hex.EncodeToString( hasher[:] )
+
+		if remote_etag, ok := have_etags[ part_number ]; ok && remote_etag == local_etag {
+			if ! quiet {
+				fmt.Printf("part %d already uploaded, skipping\n", part_number)
+			}
+			parts = append( parts, minio.CompletePart{ PartNumber: part_number, ETag: remote_etag } )
+		} else {
+			// no deadline: each part is itself a multi-MB streaming transfer
+			objPart, perr := s3_core.PutObjectPart( context.Background(), bucket, object, upload_id, part_number, bytes.NewReader(buf[:n]), int64(n), minio.PutObjectPartOptions{} )
+			if perr != nil {
+				log.Printf("error uploading part %d : %s\n", part_number, perr)
+				os.Exit(1)
+			}
+			parts = append( parts, minio.CompletePart{ PartNumber: part_number, ETag: objPart.ETag } )
+			if ! quiet {
+				fmt.Printf("uploaded part %d (%d bytes)\n", part_number, n)
+			}
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			log.Printf("error reading %s : %s\n", file_path, rerr)
+			os.Exit(1)
+		}
+		part_number++
+	}
+
+	info, err := s3_core.CompleteMultipartUpload( context.Background(), bucket, object, upload_id, parts, minio.PutObjectOptions{} )
+	if err != nil {
+		log.Printf("error completing multipart upload %s : %s\n", upload_id, err)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("completed multipart upload %s/%s, ETag=%s\n", bucket, object, info.ETag)
+	}
+}
+
+func s3_abort_multipart( bucket string, object string ) {
+	s3_setup_core_client()
+	upload_id := s3_find_multipart_upload( bucket, object )
+	if upload_id == "" {
+		if ! quiet {
+			fmt.Printf("no in-progress multipart upload for %s/%s\n", bucket, object)
+		}
+		return
+	}
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+	err := s3_core.AbortMultipartUpload( ctx, bucket, object, upload_id )
+	if err != nil {
+		log.Printf("error aborting multipart upload %s : %s\n", upload_id, err)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("aborted multipart upload %s for %s/%s\n", upload_id, bucket, object)
+	}
+}
+
+func s3_stored_sha256( bucket string, object string ) string {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+	objInfo, err := s3_client.StatObject( ctx, bucket, object, minio.StatObjectOptions{} )
+	if err != nil {
+		log.Printf("error statting %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+	return objInfo.UserMetadata["Sha256"]
+}
+
+func s3_download( bucket string, object string, file_path string ) {
+	// no deadline: this streams a potentially multi-GB image, unlike the metadata calls above
+	reader, err := s3_client.GetObject( context.Background(), bucket, object, minio.GetObjectOptions{} )
+	if err != nil {
+		log.Printf("error downloading %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+	defer reader.Close()
+
+	file, err := os.Create( file_path )
+	if err != nil {
+		log.Printf("error creating %s : %s\n", file_path, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy( io.MultiWriter( file, hasher ), reader ); err != nil {
+		log.Printf("error downloading %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+
+	sha256sum := hex.EncodeToString( hasher.Sum(nil) )
+	expected := s3_stored_sha256( bucket, object )
+	if expected != "" && expected != sha256sum {
+		log.Printf("sha256 mismatch for %s/%s: expected %s, got %s\n", bucket, object, expected, sha256sum)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("downloaded %s/%s to %s, sha256=%s\n", bucket, object, file_path, sha256sum)
+	}
+}
+
+func s3_verify_object( bucket string, object string ) {
+	// no deadline: this streams a potentially multi-GB image, unlike the metadata calls above
+	reader, err := s3_client.GetObject( context.Background(), bucket, object, minio.GetObjectOptions{} )
+	if err != nil {
+		log.Printf("error reading %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy( hasher, reader ); err != nil {
+		log.Printf("error reading %s/%s : %s\n", bucket, object, err)
+		os.Exit(1)
+	}
+
+	sha256sum := hex.EncodeToString( hasher.Sum(nil) )
+	expected := s3_stored_sha256( bucket, object )
+	if expected == "" {
+		log.Printf("%s/%s has no x-amz-meta-sha256, cannot verify\n", bucket, object)
+		os.Exit(1)
+	}
+	if expected != sha256sum {
+		log.Printf("sha256 mismatch for %s/%s: expected %s, got %s\n", bucket, object, expected, sha256sum)
+		os.Exit(1)
+	}
+	if ! quiet {
+		fmt.Printf("%s/%s verified, sha256=%s\n", bucket, object, sha256sum)
+	}
+}
+
+type SweepSummary struct {
+	Scanned int
+	Expired int
+	Removed int
+	Errors int
+	BytesReclaimed int64
+}
+
+func s3_sweep( bucket string, prefix string, suffix string, concurrency uint, remove_expired bool ) SweepSummary {
+	if concurrency < 1 {
+		log.Println( "-concurrency must be at least 1" )
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	object_ch := s3_client.ListObjects( ctx, bucket, minio.ListObjectsOptions{
+		Prefix: prefix,
+		Recursive: true,
+		WithMetadata: true,
+	})
+
+	var summary SweepSummary
+	var mu sync.Mutex
+	var expired []minio.ObjectInfo
+
+	var wg sync.WaitGroup
+	expiry := time.Hour * time.Duration( config.DefaultExpiryTime )
+	for i := uint(0); i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range object_ch {
+				if obj.Err != nil {
+					mu.Lock()
+					summary.Errors++
+					mu.Unlock()
+					continue
+				}
+				if suffix != "" && ! strings.HasSuffix( obj.Key, suffix ) {
+					continue
+				}
+				mu.Lock()
+				summary.Scanned++
+				mu.Unlock()
+				if time.Now().After( obj.LastModified.Add( expiry ) ) {
+					mu.Lock()
+					summary.Expired++
+					expired = append( expired, obj )
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if remove_expired && len(expired) > 0 {
+		remove_ch := make( chan minio.ObjectInfo )
+		go func() {
+			defer close( remove_ch )
+			for _, obj := range expired {
+				remove_ch <- obj
+			}
+		}()
+		reclaimed := make( map[string]int64 )
+		for _, obj := range expired {
+			reclaimed[ obj.Key ] = obj.Size
+		}
+		for rerr := range s3_client.RemoveObjects( ctx, bucket, remove_ch, minio.RemoveObjectsOptions{} ) {
+			if rerr.Err != nil {
+				log.Printf("error removing %s : %s\n", rerr.ObjectName, rerr.Err)
+				summary.Errors++
+				delete( reclaimed, rerr.ObjectName )
+			}
+		}
+		for _, size := range reclaimed {
+			summary.Removed++
+			summary.BytesReclaimed += size
+		}
+	}
+
+	return summary
+}
+
+func s3_print_sweep_summary( summary SweepSummary ) {
+	if json_output {
+		out, _ := json.Marshal( summary )
+		fmt.Println( string(out) )
+		return
+	}
+	fmt.Printf("scanned=%d expired=%d removed=%d errors=%d bytes_reclaimed=%d\n",
+		summary.Scanned, summary.Expired, summary.Removed, summary.Errors, summary.BytesReclaimed )
+}
+
+var watch_events_received uint64
+var watch_events_stamped uint64
+var watch_reconnects uint64
+var watch_errors uint64
+
+func s3_start_metrics_server( addr string ) {
+	mux := http.NewServeMux()
+	mux.HandleFunc( "/metrics", func( w http.ResponseWriter, r *http.Request ) {
+		fmt.Fprintf( w, "# HELP image_manager_watch_events_received_total bucket notifications received\n" )
+		fmt.Fprintf( w, "# TYPE image_manager_watch_events_received_total counter\n" )
+		fmt.Fprintf( w, "image_manager_watch_events_received_total %d\n", atomic.LoadUint64( &watch_events_received ) )
+		fmt.Fprintf( w, "# HELP image_manager_watch_events_stamped_total objects stamped with expiry-at\n" )
+		fmt.Fprintf( w, "# TYPE image_manager_watch_events_stamped_total counter\n" )
+		fmt.Fprintf( w, "image_manager_watch_events_stamped_total %d\n", atomic.LoadUint64( &watch_events_stamped ) )
+		fmt.Fprintf( w, "# HELP image_manager_watch_reconnects_total reconnect attempts to the notification stream\n" )
+		fmt.Fprintf( w, "# TYPE image_manager_watch_reconnects_total counter\n" )
+		fmt.Fprintf( w, "image_manager_watch_reconnects_total %d\n", atomic.LoadUint64( &watch_reconnects ) )
+		fmt.Fprintf( w, "# HELP image_manager_watch_errors_total errors while handling notifications\n" )
+		fmt.Fprintf( w, "# TYPE image_manager_watch_errors_total counter\n" )
+		fmt.Fprintf( w, "image_manager_watch_errors_total %d\n", atomic.LoadUint64( &watch_errors ) )
+	})
+	go func() {
+		log.Printf("metrics listening on %s\n", addr)
+		if err := http.ListenAndServe( addr, mux ); err != nil {
+			log.Printf("metrics server stopped: %s\n", err)
+		}
+	}()
+}
+
+func s3_reevaluate_expiry( bucket string, object string ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	objInfo, err := s3_client.StatObject( ctx, bucket, object, minio.StatObjectOptions{} )
+	if err != nil {
+		log.Printf("error statting %s/%s on access: %s\n", bucket, object, err)
+		atomic.AddUint64( &watch_errors, 1 )
+		return
+	}
+	expiry_at, ok := objInfo.UserMetadata["Expiry-At"]
+	if ! ok {
+		// accessed before -watch ever stamped it: record an authoritative expiry now
+		s3_stamp_expiry( bucket, object )
+		return
+	}
+	parsed, err := time.Parse( time.RFC3339, expiry_at )
+	if err != nil {
+		log.Printf("error parsing expiry-at %q on %s/%s : %s\n", expiry_at, bucket, object, err)
+		atomic.AddUint64( &watch_errors, 1 )
+		return
+	}
+	if ! quiet {
+		if time.Now().After( parsed ) {
+			fmt.Printf("%s/%s accessed, already expired at %s\n", bucket, object, expiry_at)
+		} else {
+			fmt.Printf("%s/%s accessed, expires at %s\n", bucket, object, expiry_at)
+		}
+	}
+}
+
+func s3_stamp_expiry( bucket string, object string ) {
+	ctx, cancelCtx := context.WithTimeout( context.Background(), time.Duration( config.DefaultTimeoutMS ) * time.Millisecond )
+	defer cancelCtx()
+
+	expiry_at := time.Now().Add( time.Hour * time.Duration( config.DefaultExpiryTime ) ).Format( time.RFC3339 )
+	src := minio.CopySrcOptions{ Bucket: bucket, Object: object }
+	dst := minio.CopyDestOptions{
+		Bucket: bucket,
+		Object: object,
+		ReplaceMetadata: true,
+		UserMetadata: map[string]string{ "expiry-at": expiry_at },
+	}
+	if _, err := s3_client.CopyObject( ctx, dst, src ); err != nil {
+		log.Printf("error stamping expiry-at on %s/%s : %s\n", bucket, object, err)
+		atomic.AddUint64( &watch_errors, 1 )
+		return
+	}
+	atomic.AddUint64( &watch_events_stamped, 1 )
+	if ! quiet {
+		fmt.Printf("stamped %s/%s with expiry-at=%s\n", bucket, object, expiry_at)
+	}
+}
+
+func s3_watch( bucket string, prefix string, suffix string ) {
+	events := []string{ "s3:ObjectCreated:*", "s3:ObjectAccessed:*" }
+	backoff := time.Second
+
+	for {
+		ctx, cancelCtx := context.WithCancel( context.Background() )
+		notif_ch := s3_client.ListenBucketNotification( ctx, bucket, prefix, suffix, events )
+
+		if ! quiet {
+			fmt.Printf("watching %s (prefix=%q suffix=%q) for notifications\n", bucket, prefix, suffix)
+		}
+
+		for notif := range notif_ch {
+			if notif.Err != nil {
+				log.Printf("notification stream error: %s\n", notif.Err)
+				atomic.AddUint64( &watch_errors, 1 )
+				break
+			}
+			for _, record := range notif.Records {
+				atomic.AddUint64( &watch_events_received, 1 )
+				object := record.S3.Object.Key
+				if debug {
+					log.Printf("event %s for %s/%s\n", record.EventName, bucket, object)
+				}
+				switch {
+				case strings.HasPrefix( record.EventName, "s3:ObjectCreated" ):
+					s3_stamp_expiry( bucket, object )
+				case strings.HasPrefix( record.EventName, "s3:ObjectAccessed" ):
+					s3_reevaluate_expiry( bucket, object )
+				}
+			}
+		}
+		cancelCtx()
+
+		atomic.AddUint64( &watch_reconnects, 1 )
+		if ! quiet {
+			fmt.Printf("notification stream closed, reconnecting in %s\n", backoff)
+		}
+		time.Sleep( backoff )
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
 var config_path string
 var b_write_example_config bool
 var check_obj_expiry bool
@@ -158,6 +937,32 @@ var cmdline_object string
 var remove_expired bool
 var debug bool
 var quiet bool
+var apply_lifecycle bool
+var dry_run bool
+var dump_lifecycle bool
+var put_template bool
+var template_file string
+var set_retention bool
+var legal_hold string
+var presign_get bool
+var presign_put bool
+var presign_expiry_hours uint
+var response_content_disposition string
+var response_content_type string
+var json_output bool
+var upload_mode bool
+var download_mode bool
+var verify_mode bool
+var abort_multipart bool
+var local_file string
+var part_size_mb uint
+var upload_threads uint
+var sweep_mode bool
+var sweep_prefix string
+var sweep_concurrency uint
+var watch_mode bool
+var watch_suffix string
+var metrics_addr string
 
 func main() {
 	
@@ -180,6 +985,32 @@ func main() {
 	flag.BoolVar( &quiet, "quiet", false, "run in quiet mode")
 	flag.StringVar( &cmdline_bucket, "bucket", "my-bucket", "bucket name")
 	flag.StringVar( &cmdline_object, "object", "my-image", "path to image object")
+	flag.BoolVar( &apply_lifecycle, "apply_lifecycle", false, "program bucket lifecycle configuration to auto-expire objects server-side")
+	flag.BoolVar( &dry_run, "dry_run", false, "print the lifecycle XML that would be applied instead of sending it")
+	flag.BoolVar( &dump_lifecycle, "dump_lifecycle", false, "print the bucket's current lifecycle configuration")
+	flag.BoolVar( &put_template, "put_template", false, "upload -template_file as -object and apply the configured retention")
+	flag.StringVar( &template_file, "template_file", "", "path to local template file to upload with -put_template")
+	flag.BoolVar( &set_retention, "set_retention", false, "apply the configured object-lock retention to -object")
+	flag.StringVar( &legal_hold, "legal_hold", "", "set legal hold status on -object: on|off")
+	flag.BoolVar( &presign_get, "presign_get", false, "print a presigned URL for downloading -object")
+	flag.BoolVar( &presign_put, "presign_put", false, "print a presigned URL for uploading -object")
+	flag.UintVar( &presign_expiry_hours, "presign_expiry", 0, "presigned URL validity in hours, capped at 168 (defaults to -expiry_hours)")
+	flag.StringVar( &response_content_disposition, "response_content_disposition", "", "Content-Disposition override for presigned GET URLs")
+	flag.StringVar( &response_content_type, "response_content_type", "", "Content-Type override for presigned GET URLs")
+	flag.BoolVar( &json_output, "json", false, "emit machine-readable JSON output")
+	flag.BoolVar( &upload_mode, "upload", false, "stream -file to -object, resuming an in-progress multipart upload if one exists")
+	flag.BoolVar( &download_mode, "download", false, "stream -object to -file, verifying its sha256 on the fly")
+	flag.BoolVar( &verify_mode, "verify", false, "re-hash -object and compare it against its stored sha256")
+	flag.BoolVar( &abort_multipart, "abort_multipart", false, "abort any in-progress multipart upload for -object")
+	flag.StringVar( &local_file, "file", "", "local file path used by -upload/-download")
+	flag.UintVar( &part_size_mb, "part_size", 64, "multipart upload part size in MiB")
+	flag.UintVar( &upload_threads, "upload_threads", 4, "number of concurrent upload threads")
+	flag.BoolVar( &sweep_mode, "sweep", false, "walk the whole bucket (or -prefix) and evaluate expiry in bulk")
+	flag.StringVar( &sweep_prefix, "prefix", "", "prefix to restrict -sweep/-watch to")
+	flag.UintVar( &sweep_concurrency, "concurrency", 4, "number of concurrent workers for -sweep")
+	flag.BoolVar( &watch_mode, "watch", false, "subscribe to bucket notifications and stamp new objects with their expiry")
+	flag.StringVar( &watch_suffix, "suffix", "", "suffix to restrict -watch/-sweep to")
+	flag.StringVar( &metrics_addr, "metrics_addr", "", "address to serve Prometheus-style counters on for -watch, e.g. :9100")
 	flag.Parse()
 	flagset := make(map[string]bool)
 	flag.Visit(func(f *flag.Flag) { flagset[f.Name]=true } )
@@ -208,7 +1039,7 @@ func main() {
 		log.Printf("config: %+v\n", config)
 	}
 	// merge config and cmdline
-	if flagset[ "cmdline_bucket" ] {
+	if flagset[ "bucket" ] {
 		config.DefaultBucket = cmdline_bucket
 	}
 	if flagset[ "expiry_hours" ] {
@@ -219,11 +1050,145 @@ func main() {
 		if ! flagset["object"] {
 			log.Println( "missing -object provide object name to check" )
 			os.Exit(1)}
-		if ( flagset["bucket"] || len(config.DefaultBucket) == 0 ) {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
 			log.Println( "missing bucket, provide it wth bucket or via config file" )
 			os.Exit(1)}
-			
+
 		s3_setup_client()
 		s3_check_object_expiry( config.DefaultBucket , cmdline_object, remove_expired )
 	}
+
+	if apply_lifecycle {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		if ! dry_run {
+			s3_setup_client()
+		}
+		s3_apply_lifecycle( config.DefaultBucket, dry_run )
+	}
+
+	if dump_lifecycle {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_dump_lifecycle( config.DefaultBucket )
+	}
+
+	if put_template {
+		if template_file == "" {
+			log.Println( "missing -template_file, provide path to local template to upload" )
+			os.Exit(1)}
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_put_template( config.DefaultBucket, cmdline_object, template_file )
+	}
+
+	if set_retention {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_set_retention( config.DefaultBucket, cmdline_object )
+	}
+
+	if legal_hold != "" {
+		if legal_hold != "on" && legal_hold != "off" {
+			log.Println( "-legal_hold must be 'on' or 'off'" )
+			os.Exit(1)}
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_legal_hold( config.DefaultBucket, cmdline_object, legal_hold == "on" )
+	}
+
+	if presign_get {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_presign_get( config.DefaultBucket, cmdline_object )
+	}
+
+	if presign_put {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_presign_put( config.DefaultBucket, cmdline_object )
+	}
+
+	if upload_mode {
+		if local_file == "" {
+			log.Println( "missing -file, provide path to local file to upload" )
+			os.Exit(1)}
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_upload( config.DefaultBucket, cmdline_object, local_file, uint64(part_size_mb) * 1024 * 1024, upload_threads )
+	}
+
+	if download_mode {
+		if local_file == "" {
+			log.Println( "missing -file, provide destination path to download to" )
+			os.Exit(1)}
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_download( config.DefaultBucket, cmdline_object, local_file )
+	}
+
+	if verify_mode {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		s3_verify_object( config.DefaultBucket, cmdline_object )
+	}
+
+	if abort_multipart {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_abort_multipart( config.DefaultBucket, cmdline_object )
+	}
+
+	if sweep_mode {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		s3_setup_client()
+		summary := s3_sweep( config.DefaultBucket, sweep_prefix, watch_suffix, sweep_concurrency, remove_expired )
+		s3_print_sweep_summary( summary )
+	}
+
+	if watch_mode {
+		if ( ! flagset["bucket"] && len(config.DefaultBucket) == 0 ) {
+			log.Println( "missing bucket, provide it wth bucket or via config file" )
+			os.Exit(1)}
+
+		if metrics_addr != "" {
+			s3_start_metrics_server( metrics_addr )
+		}
+		s3_setup_client()
+		s3_watch( config.DefaultBucket, sweep_prefix, watch_suffix )
+	}
 }